@@ -0,0 +1,65 @@
+package tarfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// decompressor wraps a compressed reader in one that yields the underlying
+// uncompressed tar stream.
+type decompressor func(io.Reader) (io.Reader, error)
+
+type options struct {
+	decompressor decompressor
+	logger       Logger
+}
+
+// Option configures New/NewFromReader.
+type Option func(*options)
+
+// WithDecompressor forces NewFromReader to use dec to unwrap the stream
+// instead of sniffing its magic bytes. Useful for formats tarfs doesn't
+// recognize automatically, or to skip the sniffing Peek altogether.
+func WithDecompressor(dec func(io.Reader) (io.Reader, error)) Option {
+	return func(o *options) {
+		o.decompressor = dec
+	}
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte{0x42, 0x5a, 0x68} // "BZh"
+)
+
+// detectDecompressor peeks at br's first few bytes to identify a known
+// compression format, returning a nil decompressor if the stream looks like
+// a plain uncompressed tar.
+func detectDecompressor(br *bufio.Reader) (decompressor, error) {
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return func(r io.Reader) (io.Reader, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		}, nil
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,87 @@
+package tarfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// TestNewFromReaderDetectsCompression guards against detectDecompressor
+// failing to recognize a supported format's magic bytes: the same archive
+// content must round-trip identically whether streamed plain or wrapped in
+// gzip or zstd (bzip2 has no writer in the standard library, so it's not
+// exercised here).
+func TestNewFromReaderDetectsCompression(t *testing.T) {
+	raw := buildTar(t, []tarEntry{{name: "a.txt", content: "hello"}})
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	if _, err := gw.Write(raw); err != nil {
+		t.Fatalf("gzip Write: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("gzip Close: %v", err)
+	}
+
+	var zs bytes.Buffer
+	zw, err := zstd.NewWriter(&zs)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter: %v", err)
+	}
+	if _, err := zw.Write(raw); err != nil {
+		t.Fatalf("zstd Write: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zstd Close: %v", err)
+	}
+
+	for name, data := range map[string][]byte{"plain": raw, "gzip": gz.Bytes(), "zstd": zs.Bytes()} {
+		fsys, err := NewFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("NewFromReader(%v): %v", name, err)
+		}
+		b, err := fsys.ReadFile("a.txt")
+		if err != nil {
+			t.Fatalf("ReadFile(a.txt) after %v: %v", name, err)
+		}
+		if string(b) != "hello" {
+			t.Fatalf("ReadFile(a.txt) after %v = %q, want %q", name, b, "hello")
+		}
+	}
+}
+
+// closeTrackingReader wraps an io.Reader and records whether Close was
+// called on it.
+type closeTrackingReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeTrackingReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+// TestNewFromReaderClosesDecompressor guards against the reader returned by
+// a decompressor leaking: for zstd in particular, klauspost/compress spins
+// up a pool of decode goroutines that are only released by an explicit
+// Close, which NewFromReader must call once it's done reading the tar
+// stream out of it.
+func TestNewFromReaderClosesDecompressor(t *testing.T) {
+	raw := buildTar(t, []tarEntry{{name: "a.txt", content: "hello"}})
+
+	var tracked *closeTrackingReader
+	_, err := NewFromReader(bytes.NewReader(raw), WithDecompressor(func(r io.Reader) (io.Reader, error) {
+		tracked = &closeTrackingReader{Reader: r}
+		return tracked, nil
+	}))
+	if err != nil {
+		t.Fatalf("NewFromReader: %v", err)
+	}
+	if !tracked.closed {
+		t.Fatalf("decompressed reader was never closed")
+	}
+}
@@ -0,0 +1,28 @@
+package tarfs
+
+// Logger receives tarfs' diagnostic output. *log.Logger satisfies this
+// interface already; use LoggerFunc to adapt a plain function.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// LoggerFunc adapts a function to a Logger.
+type LoggerFunc func(format string, args ...interface{})
+
+func (f LoggerFunc) Printf(format string, args ...interface{}) {
+	f(format, args...)
+}
+
+// noopLogger discards everything; it's the default so tarfs stays silent
+// unless a caller opts in with WithLogger.
+type noopLogger struct{}
+
+func (noopLogger) Printf(format string, args ...interface{}) {}
+
+// WithLogger routes tarfs' diagnostic output (currently just notices about
+// skipped, unsupported tar entries) to logger instead of discarding it.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
@@ -0,0 +1,67 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+// TestLoggerFuncForwardsToFunction guards against LoggerFunc's adapter not
+// actually calling through to the wrapped function with the given args.
+func TestLoggerFuncForwardsToFunction(t *testing.T) {
+	var gotFormat string
+	var gotArgs []interface{}
+	f := LoggerFunc(func(format string, args ...interface{}) {
+		gotFormat = format
+		gotArgs = args
+	})
+
+	f.Printf("skipping %v (%v)", "dev", 42)
+
+	if gotFormat != "skipping %v (%v)" {
+		t.Fatalf("format = %q, want %q", gotFormat, "skipping %v (%v)")
+	}
+	if len(gotArgs) != 2 || gotArgs[0] != "dev" || gotArgs[1] != 42 {
+		t.Fatalf("args = %v, want [dev 42]", gotArgs)
+	}
+}
+
+// TestWithLoggerReceivesSkippedEntryNotices guards against WithLogger not
+// actually being wired into NewFromReader: a tar entry type with no useful
+// content (a character device) should be reported to the configured logger
+// instead of silently discarded.
+func TestWithLoggerReceivesSkippedEntryNotices(t *testing.T) {
+	raw := buildTar(t, []tarEntry{
+		{name: "dev0", typeflag: tar.TypeChar},
+		{name: "a.txt", content: "hello"},
+	})
+
+	var notices []string
+	logger := LoggerFunc(func(format string, args ...interface{}) {
+		notices = append(notices, format)
+	})
+
+	fsys, err := New(raw, WithLogger(logger))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if len(notices) != 1 {
+		t.Fatalf("notices = %v, want exactly one notice about dev0", notices)
+	}
+
+	b, err := fsys.ReadFile("a.txt")
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("ReadFile(a.txt) = %q, %v", b, err)
+	}
+}
+
+// TestWithoutLoggerDoesNotPanic guards against the default noopLogger
+// breaking when it actually receives a notice (rather than this path simply
+// never being exercised).
+func TestWithoutLoggerDoesNotPanic(t *testing.T) {
+	raw := buildTar(t, []tarEntry{
+		{name: "dev0", typeflag: tar.TypeChar},
+	})
+	if _, err := New(raw); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+}
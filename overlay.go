@@ -0,0 +1,465 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// overlayEntry is a file or directory that lives entirely in an Overlay's
+// in-memory layer, shadowing (or adding to) the underlying FileSystem.
+type overlayEntry struct {
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+func (e *overlayEntry) fileInfo(name string) os.FileInfo {
+	mode := e.mode
+	if e.dir {
+		mode |= os.ModeDir
+	}
+	return &FakeFile{
+		Path:      name,
+		Len:       int64(len(e.data)),
+		FileMode:  mode,
+		Timestamp: e.modTime,
+	}
+}
+
+// Overlay wraps an immutable tarfs FileSystem with a copy-on-write layer:
+// reads fall through to base except where the overlay has a file, directory
+// or whiteout recorded for that path. It implements webdav.FileSystem so a
+// tarfs archive can be served read/write over WebDAV without ever mutating
+// the archive it was built from.
+type Overlay struct {
+	base *FileSystem
+
+	mu       sync.Mutex
+	entries  map[string]*overlayEntry // path -> overlay content, shadows base
+	whiteout map[string]bool          // path -> deleted, hides base content
+}
+
+// NewOverlay creates a writable Overlay on top of base.
+func NewOverlay(base *FileSystem) *Overlay {
+	return &Overlay{
+		base:     base,
+		entries:  make(map[string]*overlayEntry),
+		whiteout: make(map[string]bool),
+	}
+}
+
+func overlayName(name string) string {
+	name = filepath.Clean(name)
+	if len(name) > 0 && name[0] == '/' {
+		name = name[1:]
+	}
+	if name == "." {
+		name = ""
+	}
+	return name
+}
+
+func joinName(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// statLocked looks up name without acquiring o.mu; callers must hold it.
+func (o *Overlay) statLocked(name string) (os.FileInfo, error) {
+	if o.whiteout[name] {
+		return nil, os.ErrNotExist
+	}
+	if e, found := o.entries[name]; found {
+		return e.fileInfo(name), nil
+	}
+	f, err := o.base.HTTPOpen(name)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// readAllLocked returns the full contents of name without acquiring o.mu;
+// callers must hold it.
+func (o *Overlay) readAllLocked(name string) ([]byte, error) {
+	if e, found := o.entries[name]; found {
+		return append([]byte(nil), e.data...), nil
+	}
+	f, err := o.base.HTTPOpen(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// childrenLocked returns the merged, whiteout-filtered listing of name
+// without acquiring o.mu; callers must hold it.
+func (o *Overlay) childrenLocked(name string) []os.FileInfo {
+	seen := make(map[string]bool)
+	var children []os.FileInfo
+
+	if f, err := o.base.HTTPOpen(name); err == nil {
+		defer f.Close()
+		if base, err := f.Readdir(-1); err == nil {
+			for _, fi := range base {
+				child := joinName(name, fi.Name())
+				if o.whiteout[child] {
+					continue
+				}
+				if _, overridden := o.entries[child]; overridden {
+					continue
+				}
+				seen[fi.Name()] = true
+				children = append(children, fi)
+			}
+		}
+	}
+
+	prefix := name
+	if name != "" {
+		prefix += "/"
+	}
+	for path, e := range o.entries {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		rel := strings.TrimPrefix(path, prefix)
+		if rel == "" || strings.Contains(rel, "/") || seen[rel] {
+			continue
+		}
+		children = append(children, e.fileInfo(path))
+	}
+
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	return children
+}
+
+// subtreeLocked returns every base or overlay path nested under name (not
+// including name itself); callers must hold o.mu.
+func (o *Overlay) subtreeLocked(name string) []string {
+	var paths []string
+	for _, child := range o.childrenLocked(name) {
+		childPath := joinName(name, child.Name())
+		paths = append(paths, childPath)
+		if child.IsDir() {
+			paths = append(paths, o.subtreeLocked(childPath)...)
+		}
+	}
+	return paths
+}
+
+func (o *Overlay) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.statLocked(overlayName(name))
+}
+
+func (o *Overlay) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = overlayName(name)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.statLocked(name); err == nil {
+		return os.ErrExist
+	}
+	if parent, _ := filepath.Split(name); parent != "" {
+		parent = strings.TrimSuffix(parent, "/")
+		if fi, err := o.statLocked(parent); err != nil || !fi.IsDir() {
+			return os.ErrNotExist
+		}
+	}
+
+	o.entries[name] = &overlayEntry{dir: true, mode: perm, modTime: time.Now()}
+	delete(o.whiteout, name)
+	return nil
+}
+
+func (o *Overlay) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = overlayName(name)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// A plain read (flag with no write mode, no Write ever called) must not
+	// copy the file into the overlay or touch its modTime: webdav itself
+	// opens every GET this way, and a "copy-on-write" overlay that commits
+	// on every Close would really be copy-on-read.
+	writeMode := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	fi, err := o.statLocked(name)
+	switch {
+	case err == nil && fi.IsDir():
+		return &overlayDir{overlay: o, name: name}, nil
+	case err == nil:
+		var data []byte
+		if flag&os.O_TRUNC == 0 {
+			data, err = o.readAllLocked(name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		of := &overlayFile{overlay: o, name: name, data: data, dirty: writeMode}
+		if flag&os.O_APPEND != 0 {
+			of.pos = int64(len(of.data))
+		}
+		return of, nil
+	case flag&os.O_CREATE != 0:
+		o.entries[name] = &overlayEntry{mode: perm, modTime: time.Now()}
+		delete(o.whiteout, name)
+		return &overlayFile{overlay: o, name: name, dirty: true}, nil
+	default:
+		return nil, os.ErrNotExist
+	}
+}
+
+func (o *Overlay) RemoveAll(ctx context.Context, name string) error {
+	name = overlayName(name)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.statLocked(name); err != nil {
+		return os.ErrNotExist
+	}
+
+	for _, path := range o.subtreeLocked(name) {
+		delete(o.entries, path)
+		o.whiteout[path] = true
+	}
+	delete(o.entries, name)
+	o.whiteout[name] = true
+	return nil
+}
+
+func (o *Overlay) Rename(ctx context.Context, oldName, newName string) error {
+	oldName = overlayName(oldName)
+	newName = overlayName(newName)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fi, err := o.statLocked(oldName)
+	if err != nil {
+		return os.ErrNotExist
+	}
+	if _, err := o.statLocked(newName); err == nil {
+		return os.ErrExist
+	}
+
+	subtree := o.subtreeLocked(oldName)
+	if err := o.copyLocked(oldName, newName, fi); err != nil {
+		return err
+	}
+	for _, path := range subtree {
+		rel := strings.TrimPrefix(path, oldName+"/")
+		childFi, err := o.statLocked(path)
+		if err != nil {
+			continue
+		}
+		if err := o.copyLocked(path, joinName(newName, rel), childFi); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range subtree {
+		delete(o.entries, path)
+		o.whiteout[path] = true
+	}
+	delete(o.entries, oldName)
+	o.whiteout[oldName] = true
+	return nil
+}
+
+// copyLocked materializes fi (which lives at src, in base or the overlay) as
+// an overlay entry at dst; callers must hold o.mu.
+func (o *Overlay) copyLocked(src, dst string, fi os.FileInfo) error {
+	if fi.IsDir() {
+		o.entries[dst] = &overlayEntry{dir: true, mode: fi.Mode(), modTime: fi.ModTime()}
+		return nil
+	}
+	data, err := o.readAllLocked(src)
+	if err != nil {
+		return err
+	}
+	o.entries[dst] = &overlayEntry{mode: fi.Mode(), modTime: fi.ModTime(), data: data}
+	return nil
+}
+
+// commit records a closed overlayFile's final contents as the overlay entry
+// for name.
+func (o *Overlay) commit(name string, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	mode := os.FileMode(0644)
+	if e, found := o.entries[name]; found {
+		mode = e.mode
+	}
+	o.entries[name] = &overlayEntry{mode: mode, modTime: time.Now(), data: data}
+	delete(o.whiteout, name)
+}
+
+// Snapshot serializes the overlay's merged view of base plus its writes
+// (and minus anything removed) as a fresh tar stream, suitable for passing
+// back into New or NewFromReader.
+func (o *Overlay) Snapshot() io.Reader {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	o.writeSnapshot("", tw)
+	tw.Close()
+	return &buf
+}
+
+func (o *Overlay) writeSnapshot(name string, tw *tar.Writer) {
+	if name != "" {
+		fi, err := o.statLocked(name)
+		if err != nil {
+			return
+		}
+		hdr := &tar.Header{Name: name, Mode: int64(fi.Mode().Perm()), ModTime: fi.ModTime()}
+		if fi.IsDir() {
+			hdr.Name += "/"
+			hdr.Typeflag = tar.TypeDir
+			tw.WriteHeader(hdr)
+		} else {
+			// Size is taken from the bytes actually read, which tar.Writer
+			// requires to exactly match the header's Size. For a base entry
+			// both statLocked and readAllLocked go through HTTPOpen, which
+			// resolves links, so a symlink is written out as a regular file
+			// holding its target's content.
+			data, err := o.readAllLocked(name)
+			if err != nil {
+				return
+			}
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(data))
+			tw.WriteHeader(hdr)
+			tw.Write(data)
+			return
+		}
+	}
+
+	for _, child := range o.childrenLocked(name) {
+		o.writeSnapshot(joinName(name, child.Name()), tw)
+	}
+}
+
+// overlayFile is a webdav.File for a regular file backed by an in-memory
+// buffer; writes are only visible to other opens once Close commits them.
+// dirty tracks whether this handle actually needs to write back to the
+// overlay on Close, so a read-only open+close doesn't copy the file up from
+// base or touch its modTime.
+type overlayFile struct {
+	overlay *Overlay
+	name    string
+	data    []byte
+	pos     int64
+	dirty   bool
+}
+
+func (f *overlayFile) Read(p []byte) (int, error) {
+	if f.pos >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *overlayFile) Write(p []byte) (int, error) {
+	f.dirty = true
+	end := f.pos + int64(len(p))
+	if end > int64(len(f.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.data)
+		f.data = grown
+	}
+	copy(f.data[f.pos:end], p)
+	f.pos = end
+	return len(p), nil
+}
+
+func (f *overlayFile) Seek(offset int64, whence int) (int64, error) {
+	base := int64(0)
+	switch whence {
+	case io.SeekStart:
+		base = 0
+	case io.SeekCurrent:
+		base = f.pos
+	case io.SeekEnd:
+		base = int64(len(f.data))
+	default:
+		return 0, errors.New("tarfs: invalid whence")
+	}
+	f.pos = base + offset
+	return f.pos, nil
+}
+
+func (f *overlayFile) Close() error {
+	if f.dirty {
+		f.overlay.commit(f.name, f.data)
+	}
+	return nil
+}
+
+func (f *overlayFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *overlayFile) Stat() (os.FileInfo, error) {
+	return f.overlay.Stat(context.Background(), f.name)
+}
+
+// overlayDir is a webdav.File for a directory, merging base and overlay
+// children on Readdir.
+type overlayDir struct {
+	overlay *Overlay
+	name    string
+}
+
+func (d *overlayDir) Read([]byte) (int, error) {
+	return 0, errors.New("tarfs: is a directory")
+}
+
+func (d *overlayDir) Write([]byte) (int, error) {
+	return 0, errors.New("tarfs: is a directory")
+}
+
+func (d *overlayDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("tarfs: is a directory")
+}
+
+func (d *overlayDir) Close() error {
+	return nil
+}
+
+func (d *overlayDir) Stat() (os.FileInfo, error) {
+	return d.overlay.Stat(context.Background(), d.name)
+}
+
+func (d *overlayDir) Readdir(count int) ([]os.FileInfo, error) {
+	d.overlay.mu.Lock()
+	defer d.overlay.mu.Unlock()
+
+	children := d.overlay.childrenLocked(d.name)
+	if count <= 0 || count > len(children) {
+		return children, nil
+	}
+	return children[:count], nil
+}
@@ -0,0 +1,249 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestOverlayReadOnlyOpenDoesNotCommit guards against OpenFile/Close
+// committing every closed handle unconditionally: a plain read (the exact
+// sequence golang.org/x/net/webdav performs on every GET) must not copy the
+// file into the overlay or touch its reported modTime.
+func TestOverlayReadOnlyOpenDoesNotCommit(t *testing.T) {
+	base, err := New(buildTar(t, []tarEntry{
+		{name: "a.txt", content: "hello"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ov := NewOverlay(base)
+	ctx := context.Background()
+
+	before, err := ov.Stat(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Stat before read: %v", err)
+	}
+
+	f, err := ov.OpenFile(ctx, "a.txt", 0, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := ioutil.ReadAll(f); err != nil && err != io.EOF {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	after, err := ov.Stat(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Stat after read: %v", err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Fatalf("read-only open+close changed ModTime: before %v, after %v", before.ModTime(), after.ModTime())
+	}
+}
+
+// TestOverlayWriteCommits ensures the overlay still does copy-on-write for
+// handles actually opened for writing.
+func TestOverlayWriteCommits(t *testing.T) {
+	base, err := New(buildTar(t, []tarEntry{
+		{name: "a.txt", content: "hello"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ov := NewOverlay(base)
+	ctx := context.Background()
+
+	f, err := ov.OpenFile(ctx, "a.txt", os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Write([]byte("bye")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	rf, err := ov.OpenFile(ctx, "a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile (read back): %v", err)
+	}
+	defer rf.Close()
+	got, err := ioutil.ReadAll(rf)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "bye" {
+		t.Fatalf("read back a.txt = %q, want %q", got, "bye")
+	}
+}
+
+// TestSnapshotRoundTripsSymlinks guards against symlink entries being
+// dropped from Overlay.Snapshot: since they were never registered as
+// children, the base FileSystem's directory listing (which Snapshot walks)
+// never surfaced them, so a snapshotted-and-reloaded archive silently lost
+// every symlink.
+func TestSnapshotRoundTripsSymlinks(t *testing.T) {
+	base, err := New(buildTar(t, []tarEntry{
+		{name: "real.txt", content: "hello"},
+		{name: "link", typeflag: tar.TypeSymlink, linkname: "real.txt"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ov := NewOverlay(base)
+
+	reloaded, err := New(func() []byte {
+		b, err := ioutil.ReadAll(ov.Snapshot())
+		if err != nil {
+			t.Fatalf("ReadAll(Snapshot): %v", err)
+		}
+		return b
+	}())
+	if err != nil {
+		t.Fatalf("New(snapshot): %v", err)
+	}
+
+	b, err := reloaded.ReadFile("link")
+	if err != nil {
+		t.Fatalf("ReadFile(link) after round-trip: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("ReadFile(link) after round-trip = %q, want %q", b, "hello")
+	}
+}
+
+// TestOverlayMkdir covers creating a new directory, rejecting a duplicate,
+// and rejecting a directory whose parent doesn't exist.
+func TestOverlayMkdir(t *testing.T) {
+	base, err := New(buildTar(t, nil))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ov := NewOverlay(base)
+	ctx := context.Background()
+
+	if err := ov.Mkdir(ctx, "dir", 0755); err != nil {
+		t.Fatalf("Mkdir(dir): %v", err)
+	}
+	fi, err := ov.Stat(ctx, "dir")
+	if err != nil {
+		t.Fatalf("Stat(dir): %v", err)
+	}
+	if !fi.IsDir() {
+		t.Fatalf("Stat(dir).IsDir() = false, want true")
+	}
+
+	if err := ov.Mkdir(ctx, "dir", 0755); err != os.ErrExist {
+		t.Fatalf("Mkdir(dir) again = %v, want os.ErrExist", err)
+	}
+
+	if err := ov.Mkdir(ctx, "missing-parent/dir", 0755); err != os.ErrNotExist {
+		t.Fatalf("Mkdir(missing-parent/dir) = %v, want os.ErrNotExist", err)
+	}
+}
+
+// TestOverlayRemoveAllWhiteout covers removing a base file (which must hide
+// it behind a whiteout, since base itself is immutable) and removing an
+// overlay-only directory along with everything nested under it.
+func TestOverlayRemoveAllWhiteout(t *testing.T) {
+	base, err := New(buildTar(t, []tarEntry{
+		{name: "a.txt", content: "hello"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ov := NewOverlay(base)
+	ctx := context.Background()
+
+	if err := ov.RemoveAll(ctx, "a.txt"); err != nil {
+		t.Fatalf("RemoveAll(a.txt): %v", err)
+	}
+	if _, err := ov.Stat(ctx, "a.txt"); err != os.ErrNotExist {
+		t.Fatalf("Stat(a.txt) after RemoveAll = %v, want os.ErrNotExist", err)
+	}
+	// base itself must be untouched: a fresh Overlay over the same base
+	// still sees the file.
+	if _, err := NewOverlay(base).Stat(ctx, "a.txt"); err != nil {
+		t.Fatalf("Stat(a.txt) on a fresh overlay: %v", err)
+	}
+
+	if err := ov.Mkdir(ctx, "dir", 0755); err != nil {
+		t.Fatalf("Mkdir(dir): %v", err)
+	}
+	f, err := ov.OpenFile(ctx, "dir/child.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(dir/child.txt): %v", err)
+	}
+	f.Write([]byte("child"))
+	f.Close()
+
+	if err := ov.RemoveAll(ctx, "dir"); err != nil {
+		t.Fatalf("RemoveAll(dir): %v", err)
+	}
+	if _, err := ov.Stat(ctx, "dir"); err != os.ErrNotExist {
+		t.Fatalf("Stat(dir) after RemoveAll = %v, want os.ErrNotExist", err)
+	}
+	if _, err := ov.Stat(ctx, "dir/child.txt"); err != os.ErrNotExist {
+		t.Fatalf("Stat(dir/child.txt) after RemoveAll(dir) = %v, want os.ErrNotExist", err)
+	}
+}
+
+// TestOverlayRename covers renaming a base file into a new overlay path
+// (both the old name disappearing and the new name serving the old
+// content) and renaming a directory along with its nested children.
+func TestOverlayRename(t *testing.T) {
+	base, err := New(buildTar(t, []tarEntry{
+		{name: "old.txt", content: "hello"},
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/child.txt", content: "nested"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ov := NewOverlay(base)
+	ctx := context.Background()
+
+	if err := ov.Rename(ctx, "old.txt", "new.txt"); err != nil {
+		t.Fatalf("Rename(old.txt, new.txt): %v", err)
+	}
+	if _, err := ov.Stat(ctx, "old.txt"); err != os.ErrNotExist {
+		t.Fatalf("Stat(old.txt) after rename = %v, want os.ErrNotExist", err)
+	}
+	f, err := ov.OpenFile(ctx, "new.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(new.txt): %v", err)
+	}
+	got, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("ReadAll(new.txt) = %q, %v, want %q", got, err, "hello")
+	}
+
+	if err := ov.Rename(ctx, "dir", "dir2"); err != nil {
+		t.Fatalf("Rename(dir, dir2): %v", err)
+	}
+	if _, err := ov.Stat(ctx, "dir/child.txt"); err != os.ErrNotExist {
+		t.Fatalf("Stat(dir/child.txt) after rename = %v, want os.ErrNotExist", err)
+	}
+	f, err = ov.OpenFile(ctx, "dir2/child.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(dir2/child.txt): %v", err)
+	}
+	got, err = ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(got) != "nested" {
+		t.Fatalf("ReadAll(dir2/child.txt) = %q, %v, want %q", got, err, "nested")
+	}
+
+	if err := ov.Rename(ctx, "new.txt", "dir2/child.txt"); err != os.ErrExist {
+		t.Fatalf("Rename(new.txt, dir2/child.txt) = %v, want os.ErrExist", err)
+	}
+}
@@ -2,14 +2,16 @@ package tarfs
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
-	"math"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -19,28 +21,100 @@ var (
 	fileTimestamp = time.Now()
 )
 
+// maxLinkHops bounds how many symlink/hardlink indirections Open will follow
+// before giving up, protecting against cycles in the archive.
+const maxLinkHops = 32
+
+// link records a symlink or hardlink entry found in the tar stream. target is
+// the raw Linkname from the tar header; hard distinguishes TypeLink (whose
+// target is always an archive-root-relative path) from TypeSymlink (whose
+// target is resolved relative to the link's own directory, like a real
+// filesystem symlink).
+type link struct {
+	target string
+	hard   bool
+}
+
+// FileSystem is an fs.FS (via Open). HTTPOpen returns http.File values, but
+// FileSystem itself does not satisfy http.FileSystem, since its Open has the
+// fs.FS signature; http.FS(fsys) serves it over HTTP. The receiver is named
+// fsys, not fs, to avoid shadowing the io/fs package used throughout this
+// file.
 type FileSystem struct {
 	files map[string][]byte
+	// headers holds the tar.Header for each entry in files, keyed the same
+	// way, so Open can report real mode/mtime information.
+	headers map[string]*tar.Header
+	// dirs holds the synthesized directory tree, keyed by path with no
+	// leading or trailing slash ("" is the root).
+	dirs map[string]*AssetDirectory
+	// links holds symlink/hardlink entries, keyed by their own path.
+	links map[string]link
+	// logger receives diagnostic output; defaults to a no-op.
+	logger Logger
 }
 
-func (fs *FileSystem) Get(name string) []byte {
-	return fs.files[name]
+func (fsys *FileSystem) Get(name string) []byte {
+	return fsys.files[name]
 }
 
-func New(data []byte) (*FileSystem, error) {
-	fs := &FileSystem{make(map[string][]byte, 0)}
+// New builds a FileSystem from an in-memory, uncompressed tar archive. It's a
+// thin wrapper around NewFromReader for callers who already have the whole
+// archive in memory.
+func New(data []byte, opts ...Option) (*FileSystem, error) {
+	return NewFromReader(bytes.NewReader(data), opts...)
+}
 
-	remaining := data
-	for {
-		if len(remaining) == 0 {
-			break
+// NewFromReader builds a FileSystem by streaming a tar archive from r. The
+// archive may be compressed: the compression format is detected from its
+// magic bytes (gzip, bzip2 or zstd) unless WithDecompressor is given.
+func NewFromReader(r io.Reader, opts ...Option) (*FileSystem, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	br := bufio.NewReader(r)
+	decompress := o.decompressor
+	if decompress == nil {
+		detected, err := detectDecompressor(br)
+		if err != nil {
+			return nil, err
 		}
+		decompress = detected
+	}
+	if decompress != nil {
+		decompressed, err := decompress(br)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decompress tar stream: %v", err)
+		}
+		// zstd in particular spins up a pool of decode goroutines that are
+		// only released by an explicit Close; gzip.Reader and the zstd
+		// decoder's IOReadCloser both implement io.Closer for exactly this.
+		if closer, ok := decompressed.(io.Closer); ok {
+			defer closer.Close()
+		}
+		r = decompressed
+	} else {
+		r = br
+	}
 
-		// TODO: see if we can avoid having to create a new pair of readers for
-		// each file
-		br := &trackingreader{bytes.NewReader(remaining), 0}
-		tr := tar.NewReader(br)
+	logger := o.logger
+	if logger == nil {
+		logger = noopLogger{}
+	}
+
+	fsys := &FileSystem{
+		files:   make(map[string][]byte, 0),
+		headers: make(map[string]*tar.Header, 0),
+		dirs:    make(map[string]*AssetDirectory, 0),
+		links:   make(map[string]link, 0),
+		logger:  logger,
+	}
+	fsys.dirs[""] = NewAssetDirectory("")
 
+	tr := tar.NewReader(r)
+	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			// end of tar archive
@@ -50,75 +124,364 @@ func New(data []byte) (*FileSystem, error) {
 			return nil, fmt.Errorf("Unable to read next tar header: %v", err)
 		}
 
-		// Set the data to be a slice of the original
-		end := br.pos + hdr.Size
-		fs.files[hdr.Name] = remaining[br.pos:end]
-		// Round up to multiple of 512
-		end = int64(math.Ceil(float64(end)/512)) * 512
-
-		remaining = remaining[end:]
-		if err != nil {
-			return nil, fmt.Errorf("Unable to seek to next header: %v", err)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read contents of %v: %v", hdr.Name, err)
+			}
+			fsys.files[hdr.Name] = data
+			fsys.headers[hdr.Name] = hdr
+			fsys.addToTree(hdr, data)
+		case tar.TypeDir:
+			fsys.addDirToTree(hdr)
+		case tar.TypeSymlink:
+			fsys.links[strings.TrimSuffix(hdr.Name, "/")] = link{target: hdr.Linkname}
+			fsys.addLinkToTree(hdr)
+		case tar.TypeLink:
+			fsys.links[strings.TrimSuffix(hdr.Name, "/")] = link{target: hdr.Linkname, hard: true}
+			fsys.addLinkToTree(hdr)
+		default:
+			// Character/block devices, fifos and the like have no useful
+			// content to serve; skip them instead of treating their (usually
+			// empty) data block as file bytes.
+			logger.Printf("tarfs: skipping unsupported tar entry %v (type %v)", hdr.Name, hdr.Typeflag)
 		}
 	}
 
-	return fs, nil
+	return fsys, nil
 }
 
-func (fs *FileSystem) Open(name string) (http.File, error) {
-	name = filepath.Clean(name)
-	if strings.HasSuffix(name, "/") {
-		fmt.Fprintf(os.Stderr, "Returning directory for %v", name)
-		return NewAssetDirectory(name), nil
+// addToTree registers a regular file as a child of its parent directory,
+// synthesizing any intermediate directories that don't already exist.
+func (fsys *FileSystem) addToTree(hdr *tar.Header, data []byte) {
+	name := strings.TrimSuffix(hdr.Name, "/")
+	dir, _ := filepath.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+	fsys.ensureDir(dir).addChild(&FakeFile{
+		Path:      name,
+		Len:       int64(len(data)),
+		FileMode:  hdr.FileInfo().Mode(),
+		Timestamp: hdr.ModTime,
+	})
+}
+
+// addLinkToTree registers a symlink/hardlink entry as a child of its parent
+// directory, the same way addToTree does for regular files, so it shows up
+// in Readdir/ReadDir/Glob instead of only being reachable by Open resolving
+// its exact name. Len reports the length of the link's target text, the way
+// a real symlink's lstat would, since Open already resolves reads of the
+// link's own name to its target's actual content.
+func (fsys *FileSystem) addLinkToTree(hdr *tar.Header) {
+	name := strings.TrimSuffix(hdr.Name, "/")
+	dir, _ := filepath.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+	fsys.ensureDir(dir).addChild(&FakeFile{
+		Path:      name,
+		Len:       int64(len(hdr.Linkname)),
+		FileMode:  hdr.FileInfo().Mode(),
+		Timestamp: hdr.ModTime,
+	})
+}
+
+// addDirToTree records the real mode/mtime for a directory that has an
+// explicit entry in the tar stream, creating it if it wasn't already
+// synthesized as an ancestor of some other entry.
+func (fsys *FileSystem) addDirToTree(hdr *tar.Header) {
+	name := strings.TrimSuffix(hdr.Name, "/")
+	d := fsys.ensureDir(name)
+	d.FileMode = hdr.FileInfo().Mode()
+	d.Timestamp = hdr.ModTime
+}
+
+// ensureDir returns the AssetDirectory for path, creating it (and wiring it
+// up as a child of its parent) if necessary. path has no trailing slash;
+// "" refers to the root.
+func (fsys *FileSystem) ensureDir(p string) *AssetDirectory {
+	if d, found := fsys.dirs[p]; found {
+		return d
+	}
+
+	d := NewAssetDirectory(p)
+	fsys.dirs[p] = d
+	if p != "" {
+		parent, _ := filepath.Split(p)
+		parent = strings.TrimSuffix(parent, "/")
+		// Point at d's own FakeFile rather than copying it, so that a later
+		// addDirToTree updating d's mode/mtime is reflected here too.
+		fsys.ensureDir(parent).addChild(&d.FakeFile)
+	}
+	return d
+}
+
+// resolve follows symlink/hardlink entries in name until it reaches a
+// non-link path, returning an error if it follows more than maxLinkHops
+// indirections total (most likely a cycle). Unlike a lookup of name alone,
+// resolve walks name segment by segment so a symlinked directory (e.g.
+// "current" -> "release-v1.2") is substituted wherever it appears in the
+// path, not just when the whole path is itself a link.
+func (fsys *FileSystem) resolve(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+
+	pending := strings.Split(name, "/")
+	resolved := ""
+	hops := 0
+
+	for len(pending) > 0 {
+		seg := pending[0]
+		pending = pending[1:]
+
+		candidate := seg
+		if resolved != "" {
+			candidate = resolved + "/" + seg
+		}
+
+		l, isLink := fsys.links[candidate]
+		if !isLink {
+			resolved = candidate
+			continue
+		}
+
+		hops++
+		if hops > maxLinkHops {
+			return "", fmt.Errorf("tarfs: too many levels of symbolic links resolving %v", name)
+		}
+
+		target := l.target
+		if !l.hard && !strings.HasPrefix(target, "/") {
+			target = filepath.Join(filepath.Dir(candidate), target)
+		}
+		target = filepath.Clean(target)
+		target = strings.TrimPrefix(target, "/")
+
+		// target is already a full path relative to the archive root, so it
+		// replaces everything resolved so far rather than extending it. The
+		// target may itself traverse more symlinks, and whatever of name
+		// remains still needs to be appended after it; requeue both ahead of
+		// processing the rest of the original path.
+		resolved = ""
+		if target != "" && target != "." {
+			pending = append(strings.Split(target, "/"), pending...)
+		}
 	}
 
+	return resolved, nil
+}
+
+// HTTPOpen opens name as an http.File, accepting the slash-rooted names an
+// http.FileServer passes. It has the signature of http.FileSystem's Open
+// method but a different name, so it does not by itself make FileSystem an
+// http.FileSystem; Open (fs.FS) with http.FS covers that.
+func (fsys *FileSystem) HTTPOpen(name string) (http.File, error) {
+	name = filepath.Clean(name)
 	if len(name) > 0 && name[0] == '/' {
 		name = name[1:]
 	}
+	if name == "." {
+		name = ""
+	}
+
+	name, err := fsys.resolve(name)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Fprintf(os.Stderr, "name: %v\n", name)
-	if strings.HasSuffix(name, "/") {
-		return NewAssetDirectory(name), nil
+	if dir, found := fsys.dirs[name]; found {
+		return dir.open(), nil
 	}
 
-	b, found := fs.files[name]
+	b, found := fsys.files[name]
 	if !found {
 		return nil, fmt.Errorf("File %v not found", name)
 	}
-	fmt.Fprintf(os.Stderr, "Found: %v\n", name)
-	fmt.Fprintln(os.Stderr, string(b))
-	return NewAssetFile(name, b), nil
+	hdr := fsys.headers[name]
+	return &AssetFile{
+		bytes.NewReader(b),
+		ioutil.NopCloser(nil),
+		FakeFile{
+			Path:      name,
+			Len:       int64(len(b)),
+			FileMode:  hdr.FileInfo().Mode(),
+			Timestamp: hdr.ModTime,
+		},
+	}, nil
 }
 
-type trackingreader struct {
-	*bytes.Reader
+// Open implements fs.FS.
+func (fsys *FileSystem) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	internal := name
+	if internal == "." {
+		internal = ""
+	}
+
+	resolved, err := fsys.resolve(internal)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if dir, found := fsys.dirs[resolved]; found {
+		return dir.open(), nil
+	}
 
-	pos int64
+	b, found := fsys.files[resolved]
+	if !found {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	hdr := fsys.headers[resolved]
+	return &AssetFile{
+		bytes.NewReader(b),
+		ioutil.NopCloser(nil),
+		FakeFile{
+			Path:      resolved,
+			Len:       int64(len(b)),
+			FileMode:  hdr.FileInfo().Mode(),
+			Timestamp: hdr.ModTime,
+		},
+	}, nil
 }
 
-func (r *trackingreader) Read(b []byte) (int, error) {
-	n, err := r.Reader.Read(b)
-	r.pos += int64(n)
-	return n, err
+// Stat implements fs.StatFS.
+func (fsys *FileSystem) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
 }
 
-func (r *trackingreader) Advance(offset int64) error {
-	n, err := r.Reader.Seek(offset, 1)
+// ReadDir implements fs.ReadDirFS.
+func (fsys *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	f, err := fsys.Open(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	r.pos = n
-	return nil
+	defer f.Close()
+
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return dir.ReadDir(-1)
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (fsys *FileSystem) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+
+	resolved, err := fsys.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	b, found := fsys.files[resolved]
+	if !found {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), b...), nil
 }
 
-// FakeFile implements os.FileInfo interface for a given path and size
+// Glob implements fs.GlobFS.
+func (fsys *FileSystem) Glob(pattern string) ([]string, error) {
+	var names []string
+	for name := range fsys.files {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	for name := range fsys.dirs {
+		if name == "" {
+			continue
+		}
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	for name := range fsys.links {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Sub implements fs.SubFS, returning the view of fsys rooted at dir.
+func (fsys *FileSystem) Sub(dir string) (fs.FS, error) {
+	if dir == "." {
+		return fsys, nil
+	}
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	if _, found := fsys.dirs[dir]; !found {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrNotExist}
+	}
+	return &subFS{fsys: fsys, root: dir}, nil
+}
+
+// subFS is the fs.FS returned by FileSystem.Sub: it rewrites names relative
+// to root before delegating back to fsys.
+type subFS struct {
+	fsys *FileSystem
+	root string
+}
+
+func (s *subFS) rootedName(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", fs.ErrInvalid
+	}
+	if name == "." {
+		return s.root, nil
+	}
+	return s.root + "/" + name, nil
+}
+
+func (s *subFS) Open(name string) (fs.File, error) {
+	rooted, err := s.rootedName(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return s.fsys.Open(rooted)
+}
+
+// FakeFile implements os.FileInfo interface for a given path
 type FakeFile struct {
 	// Path is the path of this file
 	Path string
-	// Dir marks of the path is a directory
-	Dir bool
 	// Len is the length of the fake file, zero if it is a directory
 	Len int64
+	// FileMode is the mode of this file, including the os.ModeDir bit for
+	// directories
+	FileMode os.FileMode
+	// Timestamp is the modification time reported for this file
+	Timestamp time.Time
 }
 
 func (f *FakeFile) Name() string {
@@ -127,15 +490,11 @@ func (f *FakeFile) Name() string {
 }
 
 func (f *FakeFile) Mode() os.FileMode {
-	mode := os.FileMode(0644)
-	if f.Dir {
-		return mode | os.ModeDir
-	}
-	return mode
+	return f.FileMode
 }
 
 func (f *FakeFile) ModTime() time.Time {
-	return fileTimestamp
+	return f.Timestamp
 }
 
 func (f *FakeFile) Size() int64 {
@@ -150,18 +509,39 @@ func (f *FakeFile) Sys() interface{} {
 	return nil
 }
 
-// AssetFile implements http.File interface for a no-directory file with content
+// AssetFile implements http.File and fs.File for a no-directory file with
+// content. The backing reader is an unexported field, not embedded: embedding
+// *bytes.Reader promotes its Size() int64 method alongside FakeFile's, and
+// the two would collide as an ambiguous selector the moment AssetFile is
+// used as an os.FileInfo/fs.FileInfo (i.e. from Stat).
 type AssetFile struct {
-	*bytes.Reader
+	r io.ReadSeeker
 	io.Closer
 	FakeFile
 }
 
-func NewAssetFile(name string, content []byte) *AssetFile {
+// NewAssetFile creates an AssetFile from name and content, modified at
+// timestamp. The file is reported with regular 0644 permissions; use tarfs'
+// tar-backed Open for files whose real mode should be preserved.
+func NewAssetFile(name string, content []byte, timestamp time.Time) *AssetFile {
 	return &AssetFile{
 		bytes.NewReader(content),
 		ioutil.NopCloser(nil),
-		FakeFile{name, false, int64(len(content))}}
+		FakeFile{
+			Path:      name,
+			Len:       int64(len(content)),
+			FileMode:  0644,
+			Timestamp: timestamp,
+		},
+	}
+}
+
+func (f *AssetFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *AssetFile) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
 }
 
 func (f *AssetFile) Readdir(count int) ([]os.FileInfo, error) {
@@ -172,7 +552,7 @@ func (f *AssetFile) Stat() (os.FileInfo, error) {
 	return f, nil
 }
 
-// AssetDirectory implements http.File interface for a directory
+// AssetDirectory implements http.File and fs.ReadDirFile for a directory
 type AssetDirectory struct {
 	AssetFile
 	ChildrenRead int
@@ -185,12 +565,32 @@ func NewAssetDirectory(name string) *AssetDirectory {
 		AssetFile{
 			bytes.NewReader(nil),
 			ioutil.NopCloser(nil),
-			FakeFile{name, true, 0},
+			FakeFile{
+				Path:      name,
+				FileMode:  os.ModeDir | 0755,
+				Timestamp: fileTimestamp,
+			},
 		},
 		0,
 		fileinfos}
 }
 
+func (f *AssetDirectory) addChild(child os.FileInfo) {
+	f.Children = append(f.Children, child)
+}
+
+// open returns a handle on f with its own ChildrenRead cursor, sharing the
+// (immutable once built) Children slice. fsys.dirs holds one *AssetDirectory
+// per path; handing that singleton straight back from Open would let two
+// independently opened handles on the same directory corrupt each other's
+// Readdir/ReadDir pagination.
+func (f *AssetDirectory) open() *AssetDirectory {
+	return &AssetDirectory{
+		AssetFile: f.AssetFile,
+		Children:  f.Children,
+	}
+}
+
 func (f *AssetDirectory) Readdir(count int) ([]os.FileInfo, error) {
 	if count <= 0 {
 		return f.Children, nil
@@ -203,6 +603,19 @@ func (f *AssetDirectory) Readdir(count int) ([]os.FileInfo, error) {
 	return rv, nil
 }
 
+// ReadDir implements fs.ReadDirFile.
+func (f *AssetDirectory) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := f.Readdir(n)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, fi := range infos {
+		entries[i] = fs.FileInfoToDirEntry(fi)
+	}
+	return entries, nil
+}
+
 func (f *AssetDirectory) Stat() (os.FileInfo, error) {
 	return f, nil
 }
@@ -0,0 +1,306 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+// tarEntry describes one entry to write into a test archive built by
+// buildTar.
+type tarEntry struct {
+	name     string
+	linkname string
+	typeflag byte
+	content  string
+}
+
+// buildTar writes entries into an uncompressed tar archive and returns its
+// bytes, suitable for passing to New.
+func buildTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		typeflag := e.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: typeflag,
+			Linkname: e.linkname,
+			Size:     int64(len(e.content)),
+			Mode:     0644,
+			ModTime:  time.Unix(0, 0),
+		}
+		if typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%v): %v", e.name, err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("Write(%v): %v", e.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestDirectoryReadCursorsAreIndependent guards against regressing to a
+// single *AssetDirectory shared by every Open of the same path: two handles
+// on "." must each start their own Readdir/ReadDir pagination from the
+// beginning, independent of the other.
+func TestDirectoryReadCursorsAreIndependent(t *testing.T) {
+	fsys, err := New(buildTar(t, []tarEntry{
+		{name: "a.txt", content: "a"},
+		{name: "b.txt", content: "b"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	f1, err := fsys.Open(".")
+	if err != nil {
+		t.Fatalf("Open(.) #1: %v", err)
+	}
+	defer f1.Close()
+	f2, err := fsys.Open(".")
+	if err != nil {
+		t.Fatalf("Open(.) #2: %v", err)
+	}
+	defer f2.Close()
+
+	d1, ok := f1.(fs.ReadDirFile)
+	if !ok {
+		t.Fatalf("Open(.) #1 did not implement fs.ReadDirFile")
+	}
+	d2, ok := f2.(fs.ReadDirFile)
+	if !ok {
+		t.Fatalf("Open(.) #2 did not implement fs.ReadDirFile")
+	}
+
+	page1, err := d1.ReadDir(1)
+	if err != nil || len(page1) != 1 {
+		t.Fatalf("d1.ReadDir(1) = %v, %v", page1, err)
+	}
+	page2, err := d2.ReadDir(1)
+	if err != nil || len(page2) != 1 {
+		t.Fatalf("d2.ReadDir(1) = %v, %v", page2, err)
+	}
+	if page1[0].Name() != page2[0].Name() {
+		t.Fatalf("independent handles disagreed on their own first entry: %v vs %v", page1[0].Name(), page2[0].Name())
+	}
+}
+
+// TestResolveSymlinkedDirectory guards against resolve only matching a
+// symlink when it's the entire requested path: a symlinked directory must be
+// substituted wherever it appears as an intermediate path segment.
+func TestResolveSymlinkedDirectory(t *testing.T) {
+	fsys, err := New(buildTar(t, []tarEntry{
+		{name: "real/", typeflag: tar.TypeDir},
+		{name: "real/file.txt", content: "hello"},
+		{name: "link", typeflag: tar.TypeSymlink, linkname: "real"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	b, err := fsys.ReadFile("link/file.txt")
+	if err != nil {
+		t.Fatalf("ReadFile(link/file.txt): %v", err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("ReadFile(link/file.txt) = %q, want %q", b, "hello")
+	}
+}
+
+// TestResolveSymlinkNotFirstSegment guards against resolve appending
+// subsequent segments onto the stale prefix that preceded a link instead of
+// replacing it once the link's target (always a full archive-root-relative
+// path) is substituted in. Covers a relative link nested two levels deep, an
+// absolute-target link nested under a directory, and a ".."-target link used
+// as an intermediate directory segment.
+func TestResolveSymlinkNotFirstSegment(t *testing.T) {
+	fsys, err := New(buildTar(t, []tarEntry{
+		{name: "a/", typeflag: tar.TypeDir},
+		{name: "a/b/", typeflag: tar.TypeDir},
+		{name: "a/b/other.txt", content: "nested-relative"},
+		{name: "a/b/link", typeflag: tar.TypeSymlink, linkname: "other.txt"},
+		{name: "real.txt", content: "nested-absolute"},
+		{name: "a/link2", typeflag: tar.TypeSymlink, linkname: "/real.txt"},
+		{name: "sub/", typeflag: tar.TypeDir},
+		{name: "sub/link3", typeflag: tar.TypeSymlink, linkname: ".."},
+		{name: "file.txt", content: "dotdot-intermediate"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"a/b/link", "nested-relative"},
+		{"a/link2", "nested-absolute"},
+		{"sub/link3/file.txt", "dotdot-intermediate"},
+	} {
+		b, err := fsys.ReadFile(tc.path)
+		if err != nil {
+			t.Fatalf("ReadFile(%v): %v", tc.path, err)
+		}
+		if string(b) != tc.want {
+			t.Fatalf("ReadFile(%v) = %q, want %q", tc.path, b, tc.want)
+		}
+	}
+}
+
+// TestLinksAreListable guards against symlink/hardlink entries being parsed
+// into fsys.links but never registered as children of their parent
+// directory, which left them invisible to ReadDir and Glob even though Open
+// could still resolve them by exact name.
+func TestLinksAreListable(t *testing.T) {
+	fsys, err := New(buildTar(t, []tarEntry{
+		{name: "real.txt", content: "hello"},
+		{name: "link", typeflag: tar.TypeSymlink, linkname: "real.txt"},
+		{name: "hard", typeflag: tar.TypeLink, linkname: "real.txt"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	entries, err := fsys.ReadDir(".")
+	if err != nil {
+		t.Fatalf("ReadDir(.): %v", err)
+	}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	for _, want := range []string{"real.txt", "link", "hard"} {
+		if !names[want] {
+			t.Fatalf("ReadDir(.) = %v, missing %v", entries, want)
+		}
+	}
+
+	matches, err := fsys.Glob("l*")
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	if len(matches) != 1 || matches[0] != "link" {
+		t.Fatalf("Glob(l*) = %v, want [link]", matches)
+	}
+}
+
+// TestOpenSatisfiesFsFileInfo guards against AssetFile/AssetDirectory
+// regressing to embedding *bytes.Reader alongside FakeFile, which makes
+// Size() an ambiguous selector and breaks Stat's fs.FileInfo return.
+func TestOpenSatisfiesFsFileInfo(t *testing.T) {
+	fsys, err := New(buildTar(t, []tarEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/file.txt", content: "hello"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	fi, err := fsys.Stat("dir/file.txt")
+	if err != nil {
+		t.Fatalf("Stat(dir/file.txt): %v", err)
+	}
+	if fi.Size() != 5 {
+		t.Fatalf("Stat(dir/file.txt).Size() = %v, want 5", fi.Size())
+	}
+
+	entries, err := fsys.ReadDir("dir")
+	if err != nil {
+		t.Fatalf("ReadDir(dir): %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "file.txt" {
+		t.Fatalf("ReadDir(dir) = %v, want [file.txt]", entries)
+	}
+}
+
+// TestGlobMatchesFilesAndDirs exercises fs.GlobFS end to end: a pattern must
+// match both plain files and synthesized directories, and a pattern that
+// matches nothing returns an empty result rather than an error.
+func TestGlobMatchesFilesAndDirs(t *testing.T) {
+	fsys, err := New(buildTar(t, []tarEntry{
+		{name: "assets/", typeflag: tar.TypeDir},
+		{name: "assets/app.js", content: "js"},
+		{name: "assets/app.css", content: "css"},
+		{name: "other.txt", content: "other"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	matches, err := fsys.Glob("assets*")
+	if err != nil {
+		t.Fatalf("Glob(assets*): %v", err)
+	}
+	if len(matches) != 1 || matches[0] != "assets" {
+		t.Fatalf("Glob(assets*) = %v, want [assets]", matches)
+	}
+
+	matches, err = fsys.Glob("assets/*.js")
+	if err != nil {
+		t.Fatalf("Glob(assets/*.js): %v", err)
+	}
+	if len(matches) != 1 || matches[0] != "assets/app.js" {
+		t.Fatalf("Glob(assets/*.js) = %v, want [assets/app.js]", matches)
+	}
+
+	matches, err = fsys.Glob("nothing*")
+	if err != nil {
+		t.Fatalf("Glob(nothing*): %v", err)
+	}
+	if len(matches) != 0 {
+		t.Fatalf("Glob(nothing*) = %v, want none", matches)
+	}
+}
+
+// TestSub exercises fs.SubFS: the returned fs.FS must serve paths relative
+// to root, and Sub on a path that isn't a directory must fail.
+func TestSub(t *testing.T) {
+	fsys, err := New(buildTar(t, []tarEntry{
+		{name: "assets/", typeflag: tar.TypeDir},
+		{name: "assets/app.js", content: "js"},
+		{name: "assets/nested/", typeflag: tar.TypeDir},
+		{name: "assets/nested/deep.txt", content: "deep"},
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	sub, err := fsys.Sub("assets")
+	if err != nil {
+		t.Fatalf("Sub(assets): %v", err)
+	}
+
+	b, err := fs.ReadFile(sub, "app.js")
+	if err != nil {
+		t.Fatalf("ReadFile(app.js) via sub: %v", err)
+	}
+	if string(b) != "js" {
+		t.Fatalf("ReadFile(app.js) via sub = %q, want %q", b, "js")
+	}
+
+	b, err = fs.ReadFile(sub, "nested/deep.txt")
+	if err != nil {
+		t.Fatalf("ReadFile(nested/deep.txt) via sub: %v", err)
+	}
+	if string(b) != "deep" {
+		t.Fatalf("ReadFile(nested/deep.txt) via sub = %q, want %q", b, "deep")
+	}
+
+	if _, err := fsys.Sub("assets/app.js"); err == nil {
+		t.Fatalf("Sub(assets/app.js) on a non-directory succeeded, want an error")
+	}
+}